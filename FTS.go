@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
 	"database/sql"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"testing"
 
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
@@ -16,7 +22,73 @@ import (
 // DB connection details
 var db *sql.DB
 
+// querier is satisfied by both *sql.DB and *sql.Tx, so helpers like
+// dedupeFileChunks and fileETag can run standalone or as part of a larger
+// transaction without duplicating their logic.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// chunkSize is the fixed size used to split uploads into chunks. Resumable
+// uploads are driven entirely by byte offsets, so offsets are expected to
+// land on chunkSize boundaries.
+const chunkSize = 1 << 20 // 1MB chunks
+
+// uploadStatus mirrors the status column of file_uploads.
+const (
+	uploadStatusPending   = "pending"
+	uploadStatusCommitted = "committed"
+)
+
+// chunkBufferPool reuses the buffers chunks are read into, so a steady
+// stream of uploads doesn't churn the allocator.
+var chunkBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// inFlightChunks bounds how many chunk reads/writes run at once across all
+// concurrent uploads, capping total resident chunk memory regardless of how
+// many clients are PATCHing at the same time.
+var inFlightChunks = make(chan struct{}, runtime.NumCPU()*4)
+
+// chunkJob is one unit of work handed to the chunk worker pool: persist a
+// chunk's bytes and its MD5 so the caller can report back once it's durable.
+type chunkJob struct {
+	fileID string
+	index  int
+	data   []byte
+	md5Sum []byte
+	result chan<- error
+}
+
+var chunkJobs = make(chan chunkJob)
+
 func init() {
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go chunkWorker()
+	}
+}
+
+// chunkWorker is one of a fixed-size pool of goroutines that write chunks to
+// the database, so upload concurrency is bounded by worker count rather than
+// by however many requests happen to arrive at once.
+func chunkWorker() {
+	for job := range chunkJobs {
+		_, err := db.Exec(`INSERT INTO file_chunks (file_id, chunk_index, chunk_data, chunk_md5) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (file_id, chunk_index) DO NOTHING`, job.fileID, job.index, job.data, job.md5Sum)
+		job.result <- err
+	}
+}
+
+func init() {
+	// go test loads this package without a Postgres instance to talk to, so
+	// skip dialing one; nothing under test here exercises the db handle.
+	if testing.Testing() {
+		return
+	}
+
 	// Read environment variables for PostgreSQL connection
 	host := os.Getenv("POSTGRES_HOST")
 	port := os.Getenv("POSTGRES_PORT")
@@ -27,6 +99,7 @@ func init() {
 	// Check if any of these variables are empty
 	if host == "" || port == "" || user == "" || password == "" || dbname == "" {
 		panic("One or more environment variables are missing")
+	}
 
 	// Create PostgreSQL connection string
 	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
@@ -49,6 +122,8 @@ func init() {
 func main() {
 	// Define API endpoints
 	http.HandleFunc("/upload", uploadFileHandler)
+	http.HandleFunc("/upload/init", uploadInitHandler)
+	http.HandleFunc("/upload/finalize", uploadFinalizeHandler)
 	http.HandleFunc("/getFiles", getFilesHandler)
 	http.HandleFunc("/download", downloadFileHandler)
 
@@ -56,65 +131,318 @@ func main() {
 	http.ListenAndServe(":8080", nil)
 }
 
-// Upload file: Split into chunks and store in DB
+// uploadFileHandler dispatches the resumable upload endpoint by method:
+// PATCH carries a chunk (uploadChunkHandler), HEAD reports progress so a
+// client can resume after a failure (uploadStatusHandler).
 func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
-	// Limit upload size to 10MB
-	r.ParseMultipartForm(10 << 20)
+	switch r.Method {
+	case http.MethodPatch:
+		uploadChunkHandler(w, r)
+	case http.MethodHead:
+		uploadStatusHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-	file, handler, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Error retrieving file", http.StatusBadRequest)
+// uploadInitHandler starts a resumable upload: it records the expected
+// filename and total size in file_uploads (status "pending") and returns the
+// file_id the client must use for every subsequent chunk/finalize/status
+// call. An encrypt=1 query parameter generates a per-file AES-256-GCM data
+// key (wrapped under FSS_MASTER_KEY and stored alongside the upload); a
+// compress=1 parameter gzips each chunk before it's encrypted.
+func uploadInitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	filename := r.FormValue("filename")
+	if filename == "" {
+		http.Error(w, "filename is required", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	// Generate a unique file ID
+	totalSize, err := strconv.ParseInt(r.FormValue("total_size"), 10, 64)
+	if err != nil || totalSize <= 0 {
+		http.Error(w, "total_size must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	encrypt := r.URL.Query().Get("encrypt") == "1"
+	compress := r.URL.Query().Get("compress") == "1"
+
+	var wrappedKey []byte
+	if encrypt {
+		dataKey, err := generateDataKey()
+		if err != nil {
+			http.Error(w, "Error generating data key", http.StatusInternalServerError)
+			return
+		}
+		if wrappedKey, err = wrapDataKey(dataKey); err != nil {
+			http.Error(w, "Error wrapping data key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	fileID := uuid.New()
+	_, err = db.Exec(`INSERT INTO file_uploads (file_id, filename, total_size, status, encrypted, compressed, data_key_wrapped)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		fileID, filename, totalSize, uploadStatusPending, encrypt, compress, wrappedKey)
+	if err != nil {
+		http.Error(w, "Error starting upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(fmt.Sprintf("File ID: %s", fileID)))
+}
+
+// uploadChunkHandler stores a single chunk at a client-driven offset. The
+// insert is idempotent: retries of the same offset (e.g. after a client
+// timeout that actually succeeded) do not error or duplicate data.
+func uploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	fileID := r.URL.Query().Get("id")
+	if fileID == "" {
+		http.Error(w, "File ID is required", http.StatusBadRequest)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 || offset%chunkSize != 0 {
+		http.Error(w, "offset must be a non-negative multiple of the chunk size", http.StatusBadRequest)
+		return
+	}
+	chunkIndex := int(offset / chunkSize)
+
+	var status string
+	var totalSize int64
+	if err := db.QueryRow(`SELECT status, total_size FROM file_uploads WHERE file_id = $1`, fileID).
+		Scan(&status, &totalSize); err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if status != uploadStatusPending {
+		http.Error(w, "Upload is already finalized", http.StatusConflict)
+		return
+	}
+
+	totalChunks := int((totalSize + chunkSize - 1) / chunkSize)
+	if chunkIndex >= totalChunks {
+		http.Error(w, "offset is past the upload's declared total_size", http.StatusBadRequest)
+		return
+	}
+
+	// Cap total in-flight chunk memory: this blocks (back-pressure) rather
+	// than allocating unboundedly when many clients upload at once.
+	inFlightChunks <- struct{}{}
+	defer func() { <-inFlightChunks }()
+
+	buf := chunkBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer chunkBufferPool.Put(buf)
+
+	hasher := md5.New()
+	if _, err := io.Copy(buf, io.TeeReader(io.LimitReader(r.Body, chunkSize), hasher)); err != nil {
+		http.Error(w, "Error reading chunk", http.StatusInternalServerError)
+		return
+	}
+
+	// The buffer goes back to the pool on return, so the job gets its own
+	// copy of the bytes rather than an alias into a buffer that may be
+	// reused by another request before the worker writes it out.
+	data := make([]byte, buf.Len())
+	copy(data, buf.Bytes())
+
+	result := make(chan error, 1)
+	chunkJobs <- chunkJob{fileID: fileID, index: chunkIndex, data: data, md5Sum: hasher.Sum(nil), result: result}
+	if err := <-result; err != nil {
+		http.Error(w, "Error storing chunk", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Chunk-MD5", fmt.Sprintf("%x", hasher.Sum(nil)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadStatusHandler reports how much of an in-progress upload the server
+// has committed, so a client can resume from the right offset after a
+// failure — analogous to tus's Upload-Offset header.
+func uploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	fileID := r.URL.Query().Get("id")
+	if fileID == "" {
+		http.Error(w, "File ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM file_uploads WHERE file_id = $1)`, fileID).Scan(&exists); err != nil || !exists {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Query(`SELECT chunk_index FROM file_chunks WHERE file_id = $1 ORDER BY chunk_index`, fileID)
+	if err != nil {
+		http.Error(w, "Error reading upload progress", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
 
-	// Split the file into chunks
-	const chunkSize = 1 << 20 // 1MB chunks
-	var chunks [][]byte
-	for {
-		chunk := make([]byte, chunkSize)
-		n, err := file.Read(chunk)
-		if err != nil && err != io.EOF {
-			http.Error(w, "Error reading file", http.StatusInternalServerError)
+	var received []string
+	committedOffset := int64(0)
+	for rows.Next() {
+		var index int
+		if err := rows.Scan(&index); err != nil {
+			http.Error(w, "Error reading upload progress", http.StatusInternalServerError)
 			return
 		}
-		if n == 0 {
-			break
+		received = append(received, strconv.Itoa(index))
+		if int64(index) == committedOffset/chunkSize {
+			committedOffset += chunkSize
 		}
-		chunks = append(chunks, chunk[:n])
 	}
 
-	// Store file metadata
-	totalChunks := len(chunks)
-	_, err = db.Exec(`INSERT INTO file_metadata (file_id, filename, total_chunks) VALUES ($1, $2, $3)`, fileID, handler.Filename, totalChunks)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(committedOffset, 10))
+	w.Header().Set("X-Received-Chunks", strings.Join(received, ","))
+	w.WriteHeader(http.StatusOK)
+}
+
+// uploadFinalizeHandler seals a resumable upload once every chunk has been
+// received: it re-chunks the ingested bytes along content-defined
+// boundaries into the deduplicated `chunks`/`file_chunk_map` tables and
+// records the result in file_metadata so it is visible to
+// getFilesHandler/downloadFileHandler like any other file.
+func uploadFinalizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileID := r.URL.Query().Get("id")
+	if fileID == "" {
+		http.Error(w, "File ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	// The whole finalize is one transaction: FOR UPDATE locks the upload's
+	// row for the duration, so a second concurrent finalize call for the
+	// same id blocks here instead of racing this one into dedupeFileChunks
+	// (which would double-increment chunk refcounts). If anything below
+	// fails, the deferred Rollback discards every database write this attempt
+	// made — including any partial file_chunk_map rows — so a retried finalize
+	// starts from a clean slate instead of tripping over leftovers. Chunk
+	// bytes already written to an fs or s3 ChunkStore are not removed.
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
+		http.Error(w, "Error starting finalize", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var filename string
+	var totalSize int64
+	var status string
+	var encrypted, compressed bool
+	var wrappedKey []byte
+	err = tx.QueryRowContext(ctx, `SELECT filename, total_size, status, encrypted, compressed, data_key_wrapped
+		FROM file_uploads WHERE file_id = $1 FOR UPDATE`, fileID).
+		Scan(&filename, &totalSize, &status, &encrypted, &compressed, &wrappedKey)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if status != uploadStatusPending {
+		http.Error(w, "Upload is already finalized", http.StatusConflict)
+		return
+	}
+
+	totalChunks := int((totalSize + chunkSize - 1) / chunkSize)
+
+	// chunk_index is unique per file_id, so receivedChunks distinct indices
+	// spanning exactly [minIndex, maxIndex] can only equal totalChunks
+	// consecutive values if every index in [0, totalChunks) is present — a
+	// bare COUNT(*) can't tell a full set apart from one with a gap plugged
+	// by a stray out-of-range index.
+	var receivedChunks, minIndex, maxIndex int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(MIN(chunk_index), -1), COALESCE(MAX(chunk_index), -1)
+		FROM file_chunks WHERE file_id = $1`, fileID).Scan(&receivedChunks, &minIndex, &maxIndex); err != nil {
+		http.Error(w, "Error checking upload progress", http.StatusInternalServerError)
+		return
+	}
+	if receivedChunks != totalChunks || minIndex != 0 || maxIndex != totalChunks-1 {
+		http.Error(w, "Upload is incomplete", http.StatusConflict)
+		return
+	}
+
+	// Compute the whole-file ETag from the ingestion chunks before they're
+	// superseded by dedupeFileChunks below.
+	etag, err := fileETag(ctx, tx, fileID)
+	if err != nil {
+		http.Error(w, "Error computing file ETag", http.StatusInternalServerError)
+		return
+	}
+
+	opts := storageOptions{Compress: compressed, Encrypt: encrypted}
+	if encrypted {
+		if opts.DataKey, err = unwrapDataKey(wrappedKey); err != nil {
+			http.Error(w, "Error unwrapping data key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	dedupedChunks, err := dedupeFileChunks(ctx, tx, fileID, totalChunks, opts)
+	if err != nil {
+		http.Error(w, "Error deduplicating file chunks", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO file_metadata (file_id, filename, total_chunks, md5, encrypted, compressed, data_key_wrapped)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		fileID, filename, dedupedChunks, etag, encrypted, compressed, wrappedKey); err != nil {
 		http.Error(w, "Error storing file metadata", http.StatusInternalServerError)
 		return
 	}
+	if _, err := tx.ExecContext(ctx, `UPDATE file_uploads SET status = $1 WHERE file_id = $2`, uploadStatusCommitted, fileID); err != nil {
+		http.Error(w, "Error finalizing upload", http.StatusInternalServerError)
+		return
+	}
 
-	// Upload chunks in parallel
-	var wg sync.WaitGroup
-	wg.Add(totalChunks)
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error finalizing upload", http.StatusInternalServerError)
+		return
+	}
 
-	for index, chunk := range chunks {
-		go func(index int, chunk []byte) {
-			defer wg.Done()
-			_, err = db.Exec(`INSERT INTO file_chunks (file_id, chunk_index, chunk_data) VALUES ($1, $2, $3)`,
-				fileID, index, chunk)
-			if err != nil {
-				fmt.Println("Error storing chunk:", err)
-			}
-		}(index, chunk)
+	w.Write([]byte(fmt.Sprintf("File uploaded successfully with ID: %s, ETag: %s", fileID, etag)))
+}
+
+// fileETag combines the per-chunk MD5 sums stored alongside each chunk into a
+// composite ETag, the same way S3 composes a multipart upload's ETag: MD5 of
+// the concatenated per-part digests, suffixed with the part count. This is
+// NOT the MD5 of the file's plaintext bytes — a client can use it to compare
+// against a previous download's ETag, but not against a local `md5sum` of the
+// file. Computing a true whole-file MD5 would mean re-reading the (possibly
+// huge) file contents just to checksum it, which this avoids.
+func fileETag(ctx context.Context, q querier, fileID string) (string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT chunk_md5 FROM file_chunks WHERE file_id = $1 ORDER BY chunk_index`, fileID)
+	if err != nil {
+		return "", err
 	}
+	defer rows.Close()
 
-	// Wait for all chunks to be uploaded
-	wg.Wait()
+	composite := md5.New()
+	chunkCount := 0
+	for rows.Next() {
+		var sum []byte
+		if err := rows.Scan(&sum); err != nil {
+			return "", err
+		}
+		composite.Write(sum)
+		chunkCount++
+	}
 
-	// Respond with the file ID
-	w.Write([]byte(fmt.Sprintf("File uploaded successfully with ID: %s", fileID)))
+	return fmt.Sprintf("%x-%d", composite.Sum(nil), chunkCount), nil
 }
 
 // Get uploaded files metadata
@@ -143,7 +471,13 @@ func getFilesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(result))
 }
 
-// Download file: Retrieve and merge chunks
+// downloadFileHandler streams a file back to the client, honoring a single
+// Range header (RFC 7233) so clients can resume or seek without refetching
+// the whole thing. Chunks are fetched, decrypted/decompressed and written to
+// the response one at a time, in order — unlike the old all-at-once
+// reassembly, this keeps memory use bounded by a single chunk regardless of
+// file size, and the in-order writes are what make a byte range practical
+// (parallel fetches would need to land in that same order anyway).
 func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	// Get file ID from query parameters
 	fileID := r.URL.Query().Get("id")
@@ -153,42 +487,88 @@ func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Retrieve file metadata
-	var filename string
-	var totalChunks int
-	err := db.QueryRow(`SELECT filename, total_chunks FROM file_metadata WHERE file_id = $1`, fileID).Scan(&filename, &totalChunks)
+	var filename, etag string
+	var encrypted, compressed bool
+	var wrappedKey []byte
+	err := db.QueryRow(`SELECT filename, md5, encrypted, compressed, data_key_wrapped
+		FROM file_metadata WHERE file_id = $1`, fileID).
+		Scan(&filename, &etag, &encrypted, &compressed, &wrappedKey)
 	if err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
-	// Retrieve chunks in parallel
-	var wg sync.WaitGroup
-	wg.Add(totalChunks)
-
-	chunks := make([][]byte, totalChunks)
-
-	for i := 0; i < totalChunks; i++ {
-		go func(index int) {
-			defer wg.Done()
-			var chunkData []byte
-			err := db.QueryRow(`SELECT chunk_data FROM file_chunks WHERE file_id = $1 AND chunk_index = $2`, fileID, index).Scan(&chunkData)
-			if err != nil {
-				fmt.Println("Error retrieving chunk:", err)
-				return
-			}
-			chunks[index] = chunkData
-		}(i)
+	var dataKey []byte
+	if encrypted {
+		if dataKey, err = unwrapDataKey(wrappedKey); err != nil {
+			http.Error(w, "Error unwrapping data key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
-	wg.Wait()
+	ctx := r.Context()
+	refs, totalSize, err := fileChunkRefs(ctx, fileID)
+	if err != nil {
+		http.Error(w, "Error reading file metadata: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	// Merge chunks back into a single file
-	var mergedFile bytes.Buffer
-	for _, chunk := range chunks {
-		mergedFile.Write(chunk)
+	start, end := int64(0), totalSize-1
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var ok bool
+		if start, end, ok = parseRange(rangeHeader, totalSize); !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
+			http.Error(w, "Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		status = http.StatusPartialContent
 	}
 
-	// Send the file to the client
 	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-	w.Write(mergedFile.Bytes())
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if status == http.StatusPartialContent {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, totalSize))
+	}
+	w.WriteHeader(status)
+
+	flusher, _ := w.(http.Flusher)
+	for _, ref := range refs {
+		chunkEnd := ref.offset + int64(ref.size) - 1
+		if chunkEnd < start || ref.offset > end {
+			continue
+		}
+
+		chunkData, err := chunkStore.Get(ctx, chunkKey(ref.hash))
+		if err != nil {
+			return
+		}
+		if encrypted {
+			if chunkData, err = decryptChunk(dataKey, ref.nonce, chunkData); err != nil {
+				return
+			}
+		}
+		if compressed {
+			if chunkData, err = gzipDecompress(chunkData); err != nil {
+				return
+			}
+		}
+
+		lo := int64(0)
+		if start > ref.offset {
+			lo = start - ref.offset
+		}
+		hi := int64(len(chunkData))
+		if end < chunkEnd {
+			hi = end - ref.offset + 1
+		}
+		if _, err := w.Write(chunkData[lo:hi]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
 }
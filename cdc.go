@@ -0,0 +1,126 @@
+package main
+
+import "io"
+
+// Content-defined chunking (FastCDC) parameters. Chunk boundaries follow
+// content rather than fixed offsets, so identical byte runs across
+// different files land in the same chunk and can be deduplicated.
+const (
+	cdcMinSize = 256 * 1024 // 256KB
+	cdcAvgSize = 1 << 20    // 1MB
+	cdcMaxSize = 4 * 1024 * 1024
+)
+
+// cdcMaskS and cdcMaskL bias cut points toward cdcAvgSize: maskS (more bits
+// set, harder to satisfy) discourages cutting before the average size is
+// reached, maskL (fewer bits set, easier to satisfy) encourages cutting soon
+// after, keeping chunks from growing all the way to cdcMaxSize.
+var (
+	cdcMaskS = cdcMask(13)
+	cdcMaskL = cdcMask(11)
+)
+
+// cdcMask builds a 64-bit mask with exactly n bits set, spread across the
+// word so the gear hash's low bits alone don't dominate the comparison.
+func cdcMask(n int) uint64 {
+	var mask uint64
+	for i := 0; i < n; i++ {
+		mask |= 1 << uint(i*3)
+	}
+	return mask
+}
+
+// gearTable is FastCDC's per-byte hashing table: 256 pseudo-random uint64s,
+// one per possible byte value. It must be stable across runs and processes
+// for identical content to always produce identical chunk boundaries, so it
+// is generated at init time with a fixed seed rather than crypto/math rand.
+var gearTable [256]uint64
+
+func init() {
+	state := uint64(0x9E3779B97F4A7C15) // golden ratio constant, splitmix64 seed
+	for i := range gearTable {
+		gearTable[i] = splitmix64(&state)
+	}
+}
+
+func splitmix64(state *uint64) uint64 {
+	*state += 0x9E3779B97F4A7C15
+	z := *state
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// fastCDCCut returns the length of the next chunk within data, or -1 if no
+// cut point was found (the caller should read more data, or treat all of
+// data as the final chunk if there is no more to read).
+func fastCDCCut(data []byte) int {
+	n := len(data)
+	i := cdcMinSize
+	if i > n {
+		return -1
+	}
+
+	var hash uint64
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if i < cdcAvgSize {
+			if hash&cdcMaskS == 0 {
+				return i + 1
+			}
+		} else if hash&cdcMaskL == 0 {
+			return i + 1
+		}
+		if i+1 >= cdcMaxSize {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// cdcSplitter turns a byte stream into content-defined chunks, reading ahead
+// by at most cdcMaxSize bytes so memory use stays bounded regardless of the
+// total stream length.
+type cdcSplitter struct {
+	r   io.Reader
+	buf []byte
+}
+
+func newCDCSplitter(r io.Reader) *cdcSplitter {
+	return &cdcSplitter{r: r, buf: make([]byte, 0, cdcMaxSize)}
+}
+
+// next returns the next content-defined chunk, or io.EOF once the stream is
+// exhausted.
+func (s *cdcSplitter) next() ([]byte, error) {
+	for len(s.buf) < cdcMaxSize {
+		n, err := s.r.Read(s.buf[len(s.buf):cap(s.buf)])
+		s.buf = s.buf[:len(s.buf)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	if len(s.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := fastCDCCut(s.buf)
+	if cut <= 0 {
+		cut = len(s.buf)
+	}
+
+	chunk := make([]byte, cut)
+	copy(chunk, s.buf[:cut])
+
+	remaining := copy(s.buf, s.buf[cut:])
+	s.buf = s.buf[:remaining]
+
+	return chunk, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/bits"
+	"testing"
+)
+
+func TestCdcMask(t *testing.T) {
+	tests := []struct {
+		n        int
+		wantBits int
+	}{
+		{0, 0},
+		{1, 1},
+		{11, 11},
+		{13, 13},
+	}
+	for _, tt := range tests {
+		mask := cdcMask(tt.n)
+		if got := bits.OnesCount64(mask); got != tt.wantBits {
+			t.Errorf("cdcMask(%d) has %d bits set, want %d", tt.n, got, tt.wantBits)
+		}
+	}
+}
+
+func TestFastCDCCut(t *testing.T) {
+	t.Run("shorter than cdcMinSize never cuts", func(t *testing.T) {
+		data := make([]byte, cdcMinSize-1)
+		if cut := fastCDCCut(data); cut != -1 {
+			t.Errorf("fastCDCCut(%d bytes) = %d, want -1", len(data), cut)
+		}
+	})
+
+	t.Run("clamps to cdcMaxSize", func(t *testing.T) {
+		data := make([]byte, cdcMaxSize)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		cut := fastCDCCut(data)
+		if cut <= 0 || cut > cdcMaxSize {
+			t.Fatalf("fastCDCCut returned %d, want a cut in (0, %d]", cut, cdcMaxSize)
+		}
+	})
+
+	t.Run("never cuts before cdcMinSize", func(t *testing.T) {
+		data := make([]byte, cdcMaxSize)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		cut := fastCDCCut(data)
+		if cut != -1 && cut <= cdcMinSize {
+			t.Errorf("fastCDCCut returned %d, want > %d or -1", cut, cdcMinSize)
+		}
+	})
+}
+
+func TestCDCSplitterReassemblesInput(t *testing.T) {
+	data := make([]byte, cdcMaxSize*3+12345)
+	for i := range data {
+		data[i] = byte(i * 31 % 251)
+	}
+
+	splitter := newCDCSplitter(bytes.NewReader(data))
+	var got []byte
+	for {
+		chunk, err := splitter.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if len(chunk) > cdcMaxSize {
+			t.Fatalf("chunk of %d bytes exceeds cdcMaxSize %d", len(chunk), cdcMaxSize)
+		}
+		got = append(got, chunk...)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("reassembled %d bytes, want %d matching original", len(got), len(data))
+	}
+}
+
+func TestCDCSplitterDeterministic(t *testing.T) {
+	data := make([]byte, cdcMaxSize*2)
+	for i := range data {
+		data[i] = byte(i * 17 % 191)
+	}
+
+	splitSizes := func() []int {
+		splitter := newCDCSplitter(bytes.NewReader(data))
+		var sizes []int
+		for {
+			chunk, err := splitter.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("next: %v", err)
+			}
+			sizes = append(sizes, len(chunk))
+		}
+		return sizes
+	}
+
+	first := splitSizes()
+	second := splitSizes()
+	if len(first) != len(second) {
+		t.Fatalf("got %d chunks on first run, %d on second", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("chunk %d size = %d on first run, %d on second", i, first[i], second[i])
+		}
+	}
+}
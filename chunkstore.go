@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// ChunkStore persists chunk bytes keyed by their content hash, independent
+// of where Postgres keeps the file/chunk index. Swapping implementations
+// moves chunk bytes out of Postgres (which otherwise bloats WAL and vacuum
+// with GBs of BYTEA) onto local disk or object storage, while the
+// `chunks`/`file_chunk_map` tables stay in Postgres as the index.
+type ChunkStore interface {
+	// Put takes the querier the caller is already writing the chunk's
+	// `chunks` row through (normally the *sql.Tx a finalize opened), so a
+	// postgresChunkStore write lands on the same uncommitted transaction
+	// instead of a second connection that can't see that row yet.
+	// Backends that don't touch Postgres ignore q.
+	Put(ctx context.Context, q querier, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (size int64, err error)
+}
+
+// chunkStore is the process-wide backend selected by FSS_CHUNK_STORE:
+// "postgres" (default, current behavior), "fs", or "s3".
+var chunkStore ChunkStore
+
+func init() {
+	var err error
+	switch os.Getenv("FSS_CHUNK_STORE") {
+	case "fs":
+		chunkStore, err = newFSChunkStore(os.Getenv("FSS_FS_ROOT"))
+	case "s3":
+		chunkStore, err = newS3ChunkStore(os.Getenv("FSS_S3_BUCKET"))
+	case "", "postgres":
+		chunkStore = postgresChunkStore{}
+	default:
+		err = fmt.Errorf("unknown FSS_CHUNK_STORE %q", os.Getenv("FSS_CHUNK_STORE"))
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// chunkKey derives the ChunkStore key for a chunk from its content hash, so
+// every backend addresses the same bytes the same way.
+func chunkKey(hash []byte) string {
+	return hex.EncodeToString(hash)
+}
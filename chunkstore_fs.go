@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// fsChunkStore stores each chunk as a file under root, sharded by the first
+// two hex characters of its key (its content hash) so a large store doesn't
+// pile millions of files into one directory.
+type fsChunkStore struct {
+	root string
+}
+
+func newFSChunkStore(root string) (*fsChunkStore, error) {
+	if root == "" {
+		root = "./data/chunks"
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("creating chunk store root %s: %w", root, err)
+	}
+	return &fsChunkStore{root: root}, nil
+}
+
+func (s *fsChunkStore) path(key string) string {
+	if len(key) < 2 {
+		return filepath.Join(s.root, key)
+	}
+	return filepath.Join(s.root, key[:2], key)
+}
+
+// Put writes to a temp file in the same directory as the final path and
+// renames it into place, so a crash or interrupted write mid-chunk can never
+// leave a partial file sitting under the final key.
+func (s *fsChunkStore) Put(ctx context.Context, q querier, key string, data []byte) error {
+	path := s.path(key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fsChunkStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+func (s *fsChunkStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fsChunkStore) Stat(ctx context.Context, key string) (int64, error) {
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// postgresChunkStore keeps chunk bytes in the `chunks.data` column — the
+// original, pre-ChunkStore behavior. Kept as the default for backward
+// compatibility with deployments that haven't set FSS_CHUNK_STORE.
+type postgresChunkStore struct{}
+
+func (postgresChunkStore) Put(ctx context.Context, q querier, key string, data []byte) error {
+	hash, err := hex.DecodeString(key)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `UPDATE chunks SET data = $1 WHERE hash = $2`, data, hash)
+	return err
+}
+
+func (postgresChunkStore) Get(ctx context.Context, key string) ([]byte, error) {
+	hash, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = db.QueryRowContext(ctx, `SELECT data FROM chunks WHERE hash = $1`, hash).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("chunk %s not found", key)
+	}
+	return data, err
+}
+
+func (postgresChunkStore) Delete(ctx context.Context, key string) error {
+	hash, err := hex.DecodeString(key)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `UPDATE chunks SET data = NULL WHERE hash = $1`, hash)
+	return err
+}
+
+func (postgresChunkStore) Stat(ctx context.Context, key string) (int64, error) {
+	hash, err := hex.DecodeString(key)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	err = db.QueryRowContext(ctx, `SELECT length(data) FROM chunks WHERE hash = $1`, hash).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("chunk %s not found", key)
+	}
+	return size, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3ChunkStore stores each chunk as an object in a single S3 bucket, the
+// same filer/volume split SeaweedFS and similar systems use to keep blob
+// storage out of the metadata database.
+type s3ChunkStore struct {
+	client *s3.Client
+	bucket string
+}
+
+func newS3ChunkStore(bucket string) (*s3ChunkStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("FSS_S3_BUCKET is required when FSS_CHUNK_STORE=s3")
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	return &s3ChunkStore{client: s3.NewFromConfig(cfg), bucket: bucket}, nil
+}
+
+func (s *s3ChunkStore) objectKey(key string) string {
+	return "chunks/" + key
+}
+
+func (s *s3ChunkStore) Put(ctx context.Context, q querier, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *s3ChunkStore) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (s *s3ChunkStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	return err
+}
+
+func (s *s3ChunkStore) Stat(ctx context.Context, key string) (int64, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return aws.ToInt64(out.ContentLength), nil
+}
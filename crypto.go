@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// masterKey wraps per-file data keys so a Postgres backup alone never
+// exposes plaintext — the wrapping key lives only in the server's
+// environment. Encryption is opt-in: if FSS_MASTER_KEY isn't set,
+// masterKey stays nil and encrypt=1 uploads are rejected.
+var masterKey []byte
+
+func init() {
+	hexKey := os.Getenv("FSS_MASTER_KEY")
+	if hexKey == "" {
+		return
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 32 {
+		panic("FSS_MASTER_KEY must be a 64-character hex-encoded 32-byte AES-256 key")
+	}
+	masterKey = key
+}
+
+// generateDataKey creates a random AES-256 key for a single file's chunks.
+func generateDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// wrapDataKey encrypts a file's data key under the server master key so it
+// can be stored in file_metadata alongside the otherwise-unreadable chunks.
+func wrapDataKey(dataKey []byte) ([]byte, error) {
+	if masterKey == nil {
+		return nil, fmt.Errorf("FSS_MASTER_KEY is not configured")
+	}
+	return aesGCMSeal(masterKey, dataKey)
+}
+
+// unwrapDataKey reverses wrapDataKey.
+func unwrapDataKey(wrapped []byte) ([]byte, error) {
+	if masterKey == nil {
+		return nil, fmt.Errorf("FSS_MASTER_KEY is not configured")
+	}
+	return aesGCMOpen(masterKey, wrapped)
+}
+
+// aesGCMSeal encrypts plaintext under key, prefixing the ciphertext with its
+// randomly generated nonce so aesGCMOpen can invert it with just the key.
+func aesGCMSeal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// aesGCMOpen reverses aesGCMSeal.
+func aesGCMOpen(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed data shorter than a nonce")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// encryptChunk encrypts a single chunk under the file's data key. The nonce
+// is returned rather than prefixed to the ciphertext, since it's stored in
+// its own file_chunk_map column so a ranged read can fetch and decrypt one
+// chunk without scanning the rest.
+func encryptChunk(dataKey, plaintext []byte) (ciphertext, nonce []byte, err error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return gcm.Seal(nil, nonce, plaintext, nil), nonce, nil
+}
+
+// decryptChunk reverses encryptChunk.
+func decryptChunk(dataKey, nonce, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
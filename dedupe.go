@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+)
+
+// fileChunkReader streams the raw bytes of an already-ingested upload's
+// chunks (see file_chunks in uploadChunkHandler) in order, fetching one
+// chunk at a time so reassembly never holds the whole file in memory.
+type fileChunkReader struct {
+	ctx         context.Context
+	q           querier
+	fileID      string
+	totalChunks int
+	next        int
+	cur         []byte
+}
+
+func (r *fileChunkReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.next >= r.totalChunks {
+			return 0, io.EOF
+		}
+		if err := r.q.QueryRowContext(r.ctx, `SELECT chunk_data FROM file_chunks WHERE file_id = $1 AND chunk_index = $2`,
+			r.fileID, r.next).Scan(&r.cur); err != nil {
+			return 0, err
+		}
+		r.next++
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// storageOptions controls how dedupeFileChunks transforms each
+// content-defined chunk before it's persisted.
+type storageOptions struct {
+	Compress bool
+	Encrypt  bool
+	DataKey  []byte // required when Encrypt is set
+}
+
+// dedupeFileChunks re-chunks an upload's ingested bytes along content-defined
+// boundaries. Each chunk's bytes are written to the configured ChunkStore
+// under its SHA-256 as key; `chunks` tracks the hash and a refcount (the
+// default postgres backend also keeps the bytes in its data column), and
+// `file_chunk_map` records which chunks make up this file, in what
+// order, and how to recover the original bytes (plaintext size, and the
+// nonce if it was encrypted). Bytes are only written once per distinct
+// hash — a chunk already known to the store is just refcounted again.
+//
+// Encrypting a chunk makes its stored bytes unique to each occurrence (a
+// per-file data key and a random AES-GCM nonce), so encryption trades away
+// dedup for confidential storage. Compression is deterministic: identical
+// chunks of compressed uploads still dedupe, but not against the same bytes
+// stored uncompressed.
+//
+// q is normally the *sql.Tx the caller opened for the whole finalize, so a
+// failure partway through rolls back every row this call wrote rather than
+// leaving the file half-deduped.
+func dedupeFileChunks(ctx context.Context, q querier, fileID string, ingestChunks int, opts storageOptions) (int, error) {
+	splitter := newCDCSplitter(&fileChunkReader{ctx: ctx, q: q, fileID: fileID, totalChunks: ingestChunks})
+
+	index := 0
+	for {
+		chunk, err := splitter.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		stored := chunk
+		if opts.Compress {
+			if stored, err = gzipCompress(stored); err != nil {
+				return 0, err
+			}
+		}
+
+		var nonce []byte
+		if opts.Encrypt {
+			if stored, nonce, err = encryptChunk(opts.DataKey, stored); err != nil {
+				return 0, err
+			}
+		}
+
+		hash := sha256.Sum256(stored)
+
+		// xmax = 0 is a Postgres idiom for telling an INSERT .. ON CONFLICT
+		// apart from the UPDATE it fell back to: true only for the row this
+		// statement actually inserted.
+		var inserted bool
+		err = q.QueryRowContext(ctx, `INSERT INTO chunks (hash, refcount) VALUES ($1, 1)
+			ON CONFLICT (hash) DO UPDATE SET refcount = chunks.refcount + 1
+			RETURNING (xmax = 0)`, hash[:]).Scan(&inserted)
+		if err != nil {
+			return 0, err
+		}
+		if inserted {
+			// Pass q (the finalize's *sql.Tx) through so a postgresChunkStore
+			// write lands on the same uncommitted transaction as the chunks
+			// row insert above, rather than a second connection that can't
+			// see it yet under MVCC.
+			if err := chunkStore.Put(ctx, q, chunkKey(hash[:]), stored); err != nil {
+				return 0, err
+			}
+		}
+
+		// ON CONFLICT DO NOTHING mirrors the same idempotent-retry pattern
+		// uploadChunkHandler uses for file_chunks: a (file_id, chunk_index)
+		// that's already recorded is left alone rather than erroring.
+		if _, err := q.ExecContext(ctx, `INSERT INTO file_chunk_map (file_id, chunk_index, chunk_hash, size, compressed_size, nonce)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (file_id, chunk_index) DO NOTHING`,
+			fileID, index, hash[:], len(chunk), len(stored), nonce); err != nil {
+			return 0, err
+		}
+		index++
+	}
+
+	if _, err := q.ExecContext(ctx, `DELETE FROM file_chunks WHERE file_id = $1`, fileID); err != nil {
+		return 0, err
+	}
+
+	return index, nil
+}
+
+// chunkRef is one content-defined chunk of a finalized file, annotated with
+// its plaintext byte offset within the file so a caller can tell which
+// chunks overlap a requested byte range.
+type chunkRef struct {
+	hash   []byte
+	nonce  []byte
+	size   int   // plaintext size
+	offset int64 // plaintext offset of this chunk's first byte within the file
+}
+
+// fileChunkRefs returns a finalized file's chunks in order, along with the
+// file's total plaintext size.
+func fileChunkRefs(ctx context.Context, fileID string) ([]chunkRef, int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT chunk_hash, nonce, size FROM file_chunk_map
+		WHERE file_id = $1 ORDER BY chunk_index`, fileID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var refs []chunkRef
+	var offset int64
+	for rows.Next() {
+		var c chunkRef
+		if err := rows.Scan(&c.hash, &c.nonce, &c.size); err != nil {
+			return nil, 0, err
+		}
+		c.offset = offset
+		offset += int64(c.size)
+		refs = append(refs, c)
+	}
+	return refs, offset, rows.Err()
+}
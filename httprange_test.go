@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	const size = int64(1000)
+
+	tests := []struct {
+		name      string
+		header    string
+		size      int64
+		wantStart int64
+		wantEnd   int64
+		wantOK    bool
+	}{
+		{"start-end", "bytes=0-499", size, 0, 499, true},
+		{"start-end mid-file", "bytes=500-599", size, 500, 599, true},
+		{"open-ended", "bytes=900-", size, 900, 999, true},
+		{"suffix", "bytes=-500", size, 500, 999, true},
+		{"suffix larger than size clamps to whole file", "bytes=-5000", size, 0, 999, true},
+		{"end beyond size clamps to last byte", "bytes=0-5000", size, 0, 999, true},
+		{"single byte", "bytes=999-999", size, 999, 999, true},
+		{"whole file via open-ended", "bytes=0-", size, 0, 999, true},
+		{"missing prefix", "0-499", size, 0, 0, false},
+		{"multi-range unsupported", "bytes=0-99,200-299", size, 0, 0, false},
+		{"start beyond size", "bytes=1000-1999", size, 0, 0, false},
+		{"end before start", "bytes=500-100", size, 0, 0, false},
+		{"non-numeric start", "bytes=a-499", size, 0, 0, false},
+		{"non-numeric suffix", "bytes=-a", size, 0, 0, false},
+		{"zero suffix length", "bytes=-0", size, 0, 0, false},
+		{"malformed no dash", "bytes=500", size, 0, 0, false},
+		{"empty header", "", size, 0, 0, false},
+		{"zero size resource", "bytes=0-499", 0, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, ok := parseRange(tt.header, tt.size)
+			if ok != tt.wantOK {
+				t.Fatalf("parseRange(%q, %d) ok = %v, want %v", tt.header, tt.size, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if start != tt.wantStart || end != tt.wantEnd {
+				t.Errorf("parseRange(%q, %d) = (%d, %d), want (%d, %d)",
+					tt.header, tt.size, start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}